@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/ajgb/go-config"
 	"github.com/ajgb/go-plugin"
+	"github.com/ajgb/monitoring-plugins/graphite"
+	"github.com/ajgb/monitoring-plugins/metricsink"
+	"github.com/jmespath/go-jmespath"
+	"github.com/theory/jsonpath"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,7 +29,9 @@ var opts struct {
 	Username           string   `short:"u" long:"username" description:"Username"`
 	Password           string   `short:"p" long:"password" description:"Password"`
 	Message            string   `short:"M" long:"message" description:"Initial plugin message"`
-	Keys               []string `short:"m" long:"metric" description:"List of path based keys to query" required:"true"`
+	Keys               []string `short:"m" long:"metric" description:"List of path based keys to query"`
+	JSONPath           []string `long:"jsonpath" description:"RFC 9535 JSONPath expression to query (repeatable)"`
+	JMESPath           []string `long:"jmespath" description:"JMESPath expression to query (repeatable)"`
 	BasenameMetric     bool     `short:"b" long:"basename" description:"Ignore leading path of metrics"`
 	WarningThreshold   string   `short:"w" long:"warning" description:"Warning threshold"`
 	CriticalThreshold  string   `short:"c" long:"critical" description:"Critical threshold"`
@@ -26,10 +39,37 @@ var opts struct {
 	UOM                string   `long:"uom" description:"UOM for keys"`
 	Timeout            int      `long:"timeout" description:"Connection timeout in seconds" default:"30"`
 	Path               string   `short:"U" long:"path" description:"Handler URL path" default:"/" required:"true"`
+	Templates          []string `long:"template" description:"Graphite-style template for rewriting dotted keys into measurement+tags, e.g. measurement.host.region.field* (repeatable, evaluated longest literal prefix first)"`
+	TemplateDefault    string   `long:"template-default" description:"Fallback template applied to keys matching none of --template"`
+	Separator          string   `long:"separator" description:"Separator used to split keys for --template matching" default:"."`
+	Output             []string `long:"output" description:"Metric output backend (repeatable): nagios, graphite, influx, statsd" default:"nagios"`
+	GraphiteAddr       string   `long:"graphite-addr" description:"host:port of Graphite plaintext carbon receiver"`
+	InfluxURL          string   `long:"influx-url" description:"InfluxDB 2.x base URL"`
+	InfluxToken        string   `long:"influx-token" description:"InfluxDB 2.x API token"`
+	InfluxOrg          string   `long:"influx-org" description:"InfluxDB 2.x organisation"`
+	InfluxBucket       string   `long:"influx-bucket" description:"InfluxDB 2.x bucket"`
+	StatsdAddr         string   `long:"statsd-addr" description:"host:port of StatsD daemon"`
+	FlushTimeout       int      `long:"flush-timeout" description:"Max seconds to wait for --output sinks to flush" default:"5"`
+	Daemon             bool     `long:"daemon" description:"Run as a long-lived exporter instead of a single check"`
+	Listen             string   `long:"listen" description:"Address to serve /metrics and /check on in --daemon mode" default:":9110"`
+	Interval           int      `long:"interval" description:"Seconds between polls in --daemon mode" default:"60"`
 }
 
 type jsonData map[string]interface{}
 
+// templates holds the parsed --template patterns, or nil if none were given,
+// in which case basename falls back to its original --basename behaviour.
+var templates *graphite.Templates
+
+// sinks forwards every numeric metric to the backends selected by --output,
+// in addition to the standard Nagios perfdata exit.
+var sinks *metricsink.Set
+
+type promSample struct {
+	name  string
+	value float64
+}
+
 func main() {
 	// init plugin
 	check := checkPlugin()
@@ -37,14 +77,64 @@ func main() {
 	if err := check.ParseArgs(&opts); err != nil {
 		check.ExitCritical("Error parsing arguments: %s\n", err)
 	}
+
+	if len(opts.Keys) == 0 && len(opts.JSONPath) == 0 && len(opts.JMESPath) == 0 {
+		check.ExitCritical("At least one of -m, --jsonpath or --jmespath is required\n")
+	}
+
+	if len(opts.Templates) > 0 {
+		tpls, err := graphite.NewTemplates(opts.Templates, opts.TemplateDefault, opts.Separator)
+		if err != nil {
+			check.ExitCritical("Invalid --template: %s", err)
+		}
+		templates = tpls
+	}
+
+	backends, err := metricsink.BuildSinks(opts.Output, opts.GraphiteAddr, opts.InfluxURL, opts.InfluxToken, opts.InfluxOrg, opts.InfluxBucket, opts.StatsdAddr)
+	if err != nil {
+		check.ExitCritical("Invalid --output: %s", err)
+	}
+	sinks = metricsink.NewSet(backends...)
+
+	if opts.Daemon {
+		runDaemon()
+		return
+	}
+
 	defer check.Final()
+	defer func() {
+		for _, err := range sinks.Flush(time.Duration(opts.FlushTimeout) * time.Second) {
+			check.AddMessage("metricsink: %s", err)
+		}
+	}()
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Timeout)*time.Second)
+	defer cancel()
+	if err := RunOnce(ctx, check, nil); err != nil {
+		check.ExitCritical("%s", err)
+	}
+}
+
+// RunOnce performs a single collection pass: it fetches the configured URL
+// and evaluates -m/--jsonpath/--jmespath against the response, adding
+// metrics and messages to check exactly as the single-shot plugin always
+// has. It returns an error for a failed fetch, a malformed response body, or
+// a key/expression the response doesn't contain instead of exiting, so
+// --daemon mode can skip a bad tick; check may by then already hold the
+// initial message and the metrics of keys processed before the failure. A malformed
+// --jsonpath/--jmespath expression is a configuration error and still goes
+// through check.ExitUnknown as before, since it would recur identically on
+// every tick. If collecting is non-nil, every sample produced by this pass is
+// also appended to it, for --daemon mode to serve on /metrics; callers that
+// don't need that (a plain check, or a /check request that only cares about
+// the error) pass nil.
+func RunOnce(ctx context.Context, check *plugin.Plugin, collecting *[]promSample) error {
 	client := httpClient()
 
 	url := makeUrl()
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		check.ExitCritical("Failed to create HTTP request: %s", err)
+		return fmt.Errorf("failed to create HTTP request: %s", err)
 	}
 	req.Header.Add("User-Agent", fmt.Sprintf("%s/%s", check.Name, check.Version))
 	if opts.Username != "" {
@@ -60,55 +150,202 @@ func main() {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		check.ExitCritical("HTTP request failed: %s", err)
+		return fmt.Errorf("HTTP request failed: %s", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		check.ExitCritical("HTTP request failed: %s", resp.Status)
+		return fmt.Errorf("HTTP request failed: %s", resp.Status)
 	}
-	defer resp.Body.Close()
 
-	data, err := config.ProcessJson(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		check.ExitCritical("Failed to decode JSON response: %s", err)
+		return fmt.Errorf("failed to read HTTP response: %s", err)
 	}
-	for _, key := range opts.Keys {
-		addKey(check, data, key)
+
+	if len(opts.Keys) > 0 {
+		data, err := config.ProcessJson(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to decode JSON response: %s", err)
+		}
+		for _, key := range opts.Keys {
+			if err := addKey(check, data, key, collecting); err != nil {
+				return err
+			}
+		}
 	}
+
+	if len(opts.JSONPath) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to decode JSON response: %s", err)
+		}
+		for _, expr := range opts.JSONPath {
+			if err := addJSONPath(check, doc, expr, collecting); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(opts.JMESPath) > 0 {
+		// go-jmespath's numeric builtins (sum, avg, min, ...) type-assert
+		// elements to float64 and reject json.Number, so unlike the JSONPath
+		// and -m paths above this decodes without UseNumber.
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("failed to decode JSON response: %s", err)
+		}
+		for _, expr := range opts.JMESPath {
+			if err := addJMESPath(check, doc, expr, collecting); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-func addKey(check *plugin.Plugin, data *config.Config, key string) {
+func addKey(check *plugin.Plugin, data *config.Config, key string, collecting *[]promSample) error {
 	value, err := config.Get(data.Root, key)
 	if err != nil {
-		check.ExitUnknown("Unable to locate key %s: %s", key, err)
+		return fmt.Errorf("unable to locate key %s: %s", key, err)
 	}
 
 	switch value.(type) {
 	case json.Number:
 		value, err := data.Number(key)
 		if err != nil {
-			check.ExitUnknown("Unable to process key %s as number: %s", key, err)
+			return fmt.Errorf("unable to process key %s as number: %s", key, err)
 		}
-		check.AddMetric(basename(key), value, opts.UOM, opts.WarningThreshold, opts.CriticalThreshold)
+		addMetric(check, basename(key), value, collecting)
 	case map[string]interface{}:
 		subtree, err := data.Map(key)
 		if err != nil {
-			check.ExitUnknown("Unable to process key %s as map: %s", key, err)
+			return fmt.Errorf("unable to process key %s as map: %s", key, err)
 		}
-		for child_key, _ := range subtree {
-			addKey(check, data, fmt.Sprintf("%s.%s", key, child_key))
+		for child_key := range subtree {
+			if err := addKey(check, data, fmt.Sprintf("%s.%s", key, child_key), collecting); err != nil {
+				return err
+			}
 		}
 	case []interface{}, []string, []json.Number, []int, []float64:
 		// skip slices
 	default:
 		value, err := data.String(key)
 		if err != nil {
-			check.ExitUnknown("Unable to process key %s as string: %s", key, err)
+			return fmt.Errorf("unable to process key %s as string: %s", key, err)
 		}
 		check.AddMessage("%s is %s", basename(key), value)
 	}
+	return nil
+}
+
+// addJSONPath evaluates an RFC 9535 JSONPath expression against doc. A
+// single match is emitted under expr itself; multiple matches (from a
+// wildcard or filter selector) are emitted with an index-suffixed name, e.g.
+// "$.jobs[*].name" -> "$.jobs[*].name[0]", "$.jobs[*].name[1]", ...
+func addJSONPath(check *plugin.Plugin, doc interface{}, expr string, collecting *[]promSample) error {
+	path, err := jsonpath.Parse(expr)
+	if err != nil {
+		check.ExitUnknown("Invalid --jsonpath %q: %s", expr, err)
+	}
+
+	nodes := path.Select(doc)
+	if len(nodes) == 0 {
+		return fmt.Errorf("JSONPath %q matched nothing", expr)
+	}
+	if len(nodes) == 1 {
+		return emitValue(check, expr, nodes[0], collecting)
+	}
+	for i, node := range nodes {
+		if err := emitValue(check, fmt.Sprintf("%s[%d]", expr, i), node, collecting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addJMESPath evaluates a JMESPath expression against doc, the same way
+// addJSONPath does. A result that is itself an array (e.g. from a
+// "[?unit=='bytes'].value" filter projection) is emitted with an
+// index-suffixed name, same as multiple JSONPath matches.
+func addJMESPath(check *plugin.Plugin, doc interface{}, expr string, collecting *[]promSample) error {
+	result, err := jmespath.Search(expr, doc)
+	if err != nil {
+		check.ExitUnknown("Invalid --jmespath %q: %s", expr, err)
+	}
+	if result == nil {
+		return fmt.Errorf("JMESPath %q matched nothing", expr)
+	}
+
+	if nodes, ok := result.([]interface{}); ok {
+		for i, node := range nodes {
+			if err := emitValue(check, fmt.Sprintf("%s[%d]", expr, i), node, collecting); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return emitValue(check, expr, result, collecting)
+}
+
+// emitValue adds value to the check the same way addKey does for a dotted
+// key: numbers become metrics, objects recurse into their children, arrays
+// are skipped, everything else becomes a message. Unlike addKey it works
+// directly on decoded JSON values rather than a config.Config path, so it
+// can be shared by both the JSONPath and JMESPath selectors.
+func emitValue(check *plugin.Plugin, name string, value interface{}, collecting *[]promSample) error {
+	switch v := value.(type) {
+	case json.Number:
+		addMetric(check, basename(sanitizeLabel(name)), v, collecting)
+	case float64:
+		addMetric(check, basename(sanitizeLabel(name)), json.Number(strconv.FormatFloat(v, 'f', -1, 64)), collecting)
+	case map[string]interface{}:
+		for childKey, child := range v {
+			if err := emitValue(check, fmt.Sprintf("%s.%s", name, childKey), child, collecting); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		// skip slices, same as addKey
+	default:
+		check.AddMessage("%s is %v", basename(name), v)
+	}
+	return nil
+}
+
+var perfdataLabelRe = regexp.MustCompile(`['=|\s]`)
+
+// sanitizeLabel makes name safe to use as a perfdata label. Unlike addKey's
+// dotted -m keys, a JSONPath/JMESPath expression (the plugin's own examples
+// include things like "metrics[?unit=='bytes'].value | sum(@)") routinely
+// contains quotes, pipes, '=' and whitespace a perfdata parser would read as
+// part of the name=value syntax instead of the label itself, so strip those
+// before the expression becomes a metric name.
+func sanitizeLabel(name string) string {
+	return perfdataLabelRe.ReplaceAllString(name, "_")
+}
+
+// addMetric is the single place a numeric value reaches every configured
+// output: the Nagios perfdata exit, any --output sinks, and (when collecting
+// is non-nil) the caller's Prometheus sample buffer.
+func addMetric(check *plugin.Plugin, label string, value json.Number, collecting *[]promSample) {
+	check.AddMetric(label, value, opts.UOM, opts.WarningThreshold, opts.CriticalThreshold)
+	f, err := value.Float64()
+	if err != nil {
+		return
+	}
+	sinks.Add(label, f, nil, time.Now())
+	if collecting != nil {
+		*collecting = append(*collecting, promSample{label, f})
+	}
 }
 
 func basename(key string) string {
+	if templates != nil {
+		return templates.Apply(key)
+	}
 	if opts.BasenameMetric {
 		if i := strings.LastIndex(key, "."); i >= 0 {
 			return key[i+1:]
@@ -135,9 +372,113 @@ func httpClient() *http.Client {
 	return client
 }
 
+// daemonState is the most recent poll's outcome, served by /metrics and
+// refreshed on every tick of --interval.
+type daemonState struct {
+	samples []promSample
+	err     error
+}
+
+var (
+	stateMu sync.RWMutex
+	state   daemonState
+)
+
+// runDaemon polls the target every --interval seconds, caching the result
+// behind stateMu for /metrics. /check runs its own poll on demand instead of
+// reading the cache, so a synchronous Nagios-style invocation always
+// reflects the current state of the target.
+func runDaemon() {
+	poll()
+
+	ticker := time.NewTicker(time.Duration(opts.Interval) * time.Second)
+	defer ticker.Stop()
+	go func() {
+		for range ticker.C {
+			poll()
+		}
+	}()
+
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/check", checkHandler)
+	log.Fatal(http.ListenAndServe(opts.Listen, nil))
+}
+
+// poll runs one collection pass and stores it as the cached daemonState read
+// by /metrics.
+func poll() {
+	check := checkPlugin()
+	samples := []promSample{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Timeout)*time.Second)
+	err := RunOnce(ctx, check, &samples)
+	cancel()
+
+	stateMu.Lock()
+	state = daemonState{samples: samples, err: err}
+	stateMu.Unlock()
+
+	for _, ferr := range sinks.Flush(time.Duration(opts.FlushTimeout) * time.Second) {
+		log.Printf("metricsink: %s", ferr)
+	}
+	if err != nil {
+		log.Printf("poll failed: %s", err)
+	}
+}
+
+// metricsHandler renders the most recently cached poll as Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stateMu.RLock()
+	samples := state.samples
+	stateMu.RUnlock()
+
+	seen := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		name := promMetricName(s.name)
+		if !seen[name] {
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			seen[name] = true
+		}
+		fmt.Fprintf(w, "%s %v\n", name, s.value)
+	}
+}
+
+// checkHandler runs a synchronous poll and reports whether it succeeded: an
+// "OK" body with HTTP 200, or a "CRITICAL: <error>" body with HTTP 503, for
+// tools expecting a single Nagios-style request/response. Warning and
+// critical thresholds are not evaluated here, so a metric beyond them still
+// gets "OK".
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	check := checkPlugin()
+	err := RunOnce(r.Context(), check, nil)
+	for _, ferr := range sinks.Flush(time.Duration(opts.FlushTimeout) * time.Second) {
+		log.Printf("metricsink: %s", ferr)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "CRITICAL: %s\n", err)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+var promNameRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// promMetricName rewrites a perfdata label, which may contain Graphite-style
+// tags or characters Prometheus doesn't allow, into a valid Prometheus
+// metric name.
+func promMetricName(name string) string {
+	name = promNameRe.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
 func checkPlugin() *plugin.Plugin {
 	check := plugin.New("check_json_api", "v1.0.0")
-	check.Preamble = `Copyright (c) 2017 Alex J. G. Burzy≈Ñski (ajgb@ajgb.org)
+	check.Preamble = `Copyright (c) 2017 Alex J. G. Burzyński (ajgb@ajgb.org)
 
 This plugin tests JSON based API provided by many applications.
 `
@@ -157,6 +498,35 @@ Numeric items are added to perfomance data, anything else is added to check mess
 
 Note: Warning and critical thresholds are applied to all metrics.
 
+[--template] rewrites a dotted key into a Graphite-style measurement plus
+tags, the same way Telegraf's graphite input parses keys, giving a perfdata
+label of "measurement,tag1=v1,tag2=v2.field" instead of the raw dotted key.
+Multiple [--template] patterns are evaluated longest literal prefix first;
+[--template-default] is used for keys matching none of them.
+
+[--output] forwards every numeric metric to one or more backends in addition
+to the standard Nagios perfdata exit: "graphite" (plaintext carbon protocol,
+[--graphite-addr]), "influx" (InfluxDB 2.x line protocol, [--influx-url]
+[--influx-token] [--influx-org] [--influx-bucket]) and "statsd" (gauges,
+[--statsd-addr]). Repeat [--output] to feed several at once. Sinks are
+flushed in parallel and abandoned after [--flush-timeout] seconds so a slow
+backend cannot delay the check's own exit.
+
+[--jsonpath] (RFC 9535) and [--jmespath] are an alternative to -m for
+responses the dotted-key syntax can't reach, in particular arrays: a
+wildcard or filter expression matching several values is emitted with an
+index-suffixed name, e.g. "builds[0].duration", "builds[1].duration".
+Expressions resolving to an object recurse into its children the same way
+-m does. Both are repeatable and can be mixed freely with -m.
+
+[--daemon] runs the plugin as a long-lived exporter instead of exiting after
+one check: it polls the target every [--interval] seconds and listens on
+[--listen], serving the latest poll as Prometheus gauges on /metrics while
+still answering /check synchronously with an "OK"/"CRITICAL" body and a
+matching HTTP status, for tools that expect a single Nagios-style
+request/response. /check reports CRITICAL only when the poll itself fails;
+warning and critical thresholds are not applied to it.
+
 Examples:
 - Check expvar metrics for InfluxDB
 $ check_api_json -H localhost -P 8086 -U /debug/vars -b -M "Memstats metrics" -m memstats.Alloc -m memstats.GCCPUFraction
@@ -165,6 +535,21 @@ OK: Memstats metrics | Alloc=52836064;;;; GCCPUFraction=0.0001307805780720632;;;
 - Check Jenkins test job results
 $ check_api_json -H localhost -U /job/PROJECT/api/json -M "Job Summary" -m healthReport.0.description
 OK: Job Summary, Test Result: 1,234 tests failing out of a total of 56,789 tests.
+
+- Rewrite a flattened key into measurement+tags using a template
+$ check_api_json -H localhost -U /stats -m cluster.nodeA.disk.used --template "measurement.host.field*"
+OK: http://localhost:8080/stats | cluster,host=nodeA.disk.used=728374;;;;
+
+- Alert on failed Jenkins jobs using JSONPath
+$ check_api_json -H localhost -U /api/json --jsonpath '$.jobs[?(@.color=="red")].name'
+OK: http://localhost:8080/api/json, $.jobs[?(@.color=="red")].name is nightly-build
+
+- Sum byte metrics from a heterogeneous array using JMESPath
+$ check_api_json -H localhost -U /metrics --jmespath "metrics[?unit=='bytes'].value | sum(@)"
+OK: http://localhost:8080/metrics | metrics[?unit___bytes_].value___sum(@)=41943040;;;;
+
+- Run as a Prometheus exporter, polling every 30s
+$ check_api_json -H localhost -U /stats -m cluster.nodeA.disk.used --daemon --listen :9110 --interval 30
 `
 	return check
 }
@@ -0,0 +1,166 @@
+// Package graphite implements Graphite-parser-style templates
+// (https://github.com/influxdata/telegraf graphite input conventions) for
+// rewriting dotted metric keys, such as those produced by addKey in
+// check_api_json or the metric names of check_influxdb, into a measurement
+// name plus a tag set.
+package graphite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	kindMeasurement = "measurement"
+	kindField       = "field"
+)
+
+// token is one position in a parsed template, e.g. "host" or "field*".
+type token struct {
+	name     string // "measurement", "field", or a tag key
+	wildcard bool   // true if this (always last) token absorbs remaining components
+}
+
+// Template is a single parsed pattern, e.g. "measurement.host.region.field*".
+type Template struct {
+	tokens    []token
+	separator string
+}
+
+// NewTemplate parses one template pattern. separator defaults to "." and is
+// used both to split the pattern itself and, later, the keys matched against it.
+func NewTemplate(pattern, separator string) (*Template, error) {
+	if separator == "" {
+		separator = "."
+	}
+	fields := strings.Split(pattern, separator)
+	tokens := make([]token, 0, len(fields))
+	for i, f := range fields {
+		wildcard := strings.HasSuffix(f, "*")
+		name := strings.TrimSuffix(f, "*")
+		if name == "" {
+			return nil, fmt.Errorf("empty template component in %q", pattern)
+		}
+		if wildcard && i != len(fields)-1 {
+			return nil, fmt.Errorf("wildcard component must be last in %q", pattern)
+		}
+		tokens = append(tokens, token{name: name, wildcard: wildcard})
+	}
+	return &Template{tokens: tokens, separator: separator}, nil
+}
+
+// specificity is the length of the template's fixed (non-wildcard) prefix.
+// Templates with a longer literal prefix are matched first.
+func (t *Template) specificity() int {
+	n := 0
+	for _, tok := range t.tokens {
+		if tok.wildcard {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// Match splits key by the template's separator and maps each component onto
+// the template's tokens, returning a perfdata label of the form
+// "measurement,tag1=v1,tag2=v2.field". It returns false if key has fewer
+// components than the template requires, or, when the template has no
+// trailing wildcard, more components than the template has tokens: without
+// this a non-wildcard template would silently absorb and drop the extra
+// components of a longer key, mapping distinct keys to the same label.
+func (t *Template) Match(key string) (string, bool) {
+	parts := strings.Split(key, t.separator)
+	lastWildcard := len(t.tokens) > 0 && t.tokens[len(t.tokens)-1].wildcard
+	if lastWildcard {
+		if len(parts) < len(t.tokens) {
+			return "", false
+		}
+	} else if len(parts) != len(t.tokens) {
+		return "", false
+	}
+
+	var measurement, field string
+	tags := make([]string, 0, len(t.tokens))
+
+	for i, tok := range t.tokens {
+		value := parts[i]
+		if tok.wildcard {
+			value = strings.Join(parts[i:], t.separator)
+		}
+		switch tok.name {
+		case kindMeasurement:
+			measurement = value
+		case kindField:
+			field = value
+		default:
+			tags = append(tags, fmt.Sprintf("%s=%s", tok.name, value))
+		}
+		if tok.wildcard {
+			break
+		}
+	}
+
+	label := measurement
+	if len(tags) > 0 {
+		label += "," + strings.Join(tags, ",")
+	}
+	if field != "" {
+		label += "." + field
+	}
+	return label, true
+}
+
+// Templates is an ordered set of template patterns plus an optional fallback
+// template used for keys that match none of them.
+type Templates struct {
+	templates []*Template
+	fallback  *Template
+}
+
+// NewTemplates parses patterns and sorts them by specificity, longest
+// literal prefix first, so the most specific template is tried first
+// regardless of the order the user supplied them in. defaultPattern, if
+// given, is parsed the same way as patterns.
+func NewTemplates(patterns []string, defaultPattern, separator string) (*Templates, error) {
+	parsed := make([]*Template, 0, len(patterns))
+	for _, p := range patterns {
+		tpl, err := NewTemplate(p, separator)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, tpl)
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return parsed[i].specificity() > parsed[j].specificity()
+	})
+
+	var fallback *Template
+	if defaultPattern != "" {
+		tpl, err := NewTemplate(defaultPattern, separator)
+		if err != nil {
+			return nil, err
+		}
+		fallback = tpl
+	}
+
+	return &Templates{templates: parsed, fallback: fallback}, nil
+}
+
+// Apply returns the perfdata label for key: the first matching template, the
+// configured fallback template if none match, or key itself if no fallback
+// was given or the fallback doesn't match either.
+func (t *Templates) Apply(key string) string {
+	for _, tpl := range t.templates {
+		if label, ok := tpl.Match(key); ok {
+			return label
+		}
+	}
+	if t.fallback != nil {
+		if label, ok := t.fallback.Match(key); ok {
+			return label
+		}
+	}
+	return key
+}
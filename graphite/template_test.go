@@ -0,0 +1,139 @@
+package graphite
+
+import "testing"
+
+func TestTemplateMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   string
+		key       string
+		wantLabel string
+		wantOK    bool
+	}{
+		{
+			name:      "wildcard field absorbs remaining components",
+			pattern:   "measurement.host.field*",
+			key:       "cluster.nodeA.disk.used",
+			wantLabel: "cluster,host=nodeA.disk.used",
+			wantOK:    true,
+		},
+		{
+			name:      "non-wildcard exact length matches",
+			pattern:   "measurement.host.field",
+			key:       "cluster.nodeA.used",
+			wantLabel: "cluster,host=nodeA.used",
+			wantOK:    true,
+		},
+		{
+			name:    "key shorter than template never matches",
+			pattern: "measurement.host.region.field*",
+			key:     "cluster.nodeA",
+			wantOK:  false,
+		},
+		{
+			name:    "non-wildcard template rejects a longer key instead of truncating it",
+			pattern: "measurement.host.field",
+			key:     "cluster.nodeA.disk.used",
+			wantOK:  false,
+		},
+		{
+			name:      "measurement-only template with no field or tags",
+			pattern:   "measurement*",
+			key:       "uptime",
+			wantLabel: "uptime",
+			wantOK:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := NewTemplate(tt.pattern, "")
+			if err != nil {
+				t.Fatalf("NewTemplate(%q) returned error: %s", tt.pattern, err)
+			}
+			label, ok := tpl.Match(tt.key)
+			if ok != tt.wantOK {
+				t.Fatalf("Match(%q) ok = %v, want %v", tt.key, ok, tt.wantOK)
+			}
+			if ok && label != tt.wantLabel {
+				t.Errorf("Match(%q) = %q, want %q", tt.key, label, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestNewTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+	}{
+		{"empty component", "measurement..field"},
+		{"wildcard not last", "measurement*.field"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTemplate(tt.pattern, "."); err == nil {
+				t.Fatalf("NewTemplate(%q) returned nil error, want one", tt.pattern)
+			}
+		})
+	}
+}
+
+func TestTemplatesApplyOrdersBySpecificity(t *testing.T) {
+	// The more specific "measurement.host.region.field*" pattern is supplied
+	// second, but must still be tried before the less specific
+	// "measurement.host.field*" regardless of input order.
+	templates, err := NewTemplates([]string{
+		"measurement.host.field*",
+		"measurement.host.region.field*",
+	}, "", ".")
+	if err != nil {
+		t.Fatalf("NewTemplates returned error: %s", err)
+	}
+
+	got := templates.Apply("cluster.nodeA.us-east.disk.used")
+	want := "cluster,host=nodeA,region=us-east.disk.used"
+	if got != want {
+		t.Errorf("Apply = %q, want %q", got, want)
+	}
+}
+
+func TestTemplatesApplyFallback(t *testing.T) {
+	templates, err := NewTemplates(
+		[]string{"measurement.host.field*"},
+		"measurement.field*",
+		".",
+	)
+	if err != nil {
+		t.Fatalf("NewTemplates returned error: %s", err)
+	}
+
+	// Matches the configured --template.
+	if got, want := templates.Apply("cluster.nodeA.disk.used"), "cluster,host=nodeA.disk.used"; got != want {
+		t.Errorf("Apply(matching) = %q, want %q", got, want)
+	}
+
+	// Matches none of --template, so --template-default is parsed and applied
+	// instead of being returned as a literal label.
+	if got, want := templates.Apply("cluster.used"), "cluster.used"; got != want {
+		t.Errorf("Apply(fallback) = %q, want %q", got, want)
+	}
+
+	// Two distinct keys falling back must not collapse to the same label.
+	if got, want := templates.Apply("cluster.free"), "cluster.free"; got != want {
+		t.Errorf("Apply(fallback) = %q, want %q", got, want)
+	}
+}
+
+func TestTemplatesApplyNoMatchReturnsKey(t *testing.T) {
+	templates, err := NewTemplates([]string{"measurement.host.field*"}, "", ".")
+	if err != nil {
+		t.Fatalf("NewTemplates returned error: %s", err)
+	}
+
+	key := "cluster.used"
+	if got := templates.Apply(key); got != key {
+		t.Errorf("Apply(%q) = %q, want unchanged key", key, got)
+	}
+}
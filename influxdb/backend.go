@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// metricRow is one (series, tags, metric name, value) tuple, independent of
+// whether it was produced by a v1 InfluxQL row or a v2 Flux table record.
+type metricRow struct {
+	Series string
+	Tags   map[string]string
+	Name   string
+	Value  int64
+}
+
+// queryBackend hides the differences between the InfluxDB 1.x HTTP API
+// (InfluxQL over client/v2) and the 2.x API (Flux over the v2 HTTP client)
+// behind a single shape the rest of the plugin can iterate over.
+type queryBackend interface {
+	// StatsQuery builds the mode-specific script used by "stats" run mode.
+	StatsQuery(module string) string
+	// Execute runs query (InfluxQL or Flux, depending on the backend) and
+	// returns every matching metric as a flat list. It aborts and returns
+	// ctx.Err() once ctx is done.
+	Execute(ctx context.Context, runMode, query string) ([]metricRow, error)
+	// Close releases any underlying client connection.
+	Close() error
+}
+
+// v1Backend talks InfluxQL to an InfluxDB 1.x server via client/v2.
+type v1Backend struct {
+	db client.Client
+}
+
+func newV1Backend() (*v1Backend, error) {
+	clientConfig := client.HTTPConfig{
+		Addr:               fmt.Sprintf("%s://%s:%d", opts.Schema, opts.Hostname, opts.Port),
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		Timeout:            time.Duration(opts.Timeout) * time.Second,
+	}
+	if len(opts.Username) > 0 {
+		clientConfig.Username = opts.Username
+		clientConfig.Password = opts.Password
+	}
+	db, err := client.NewHTTPClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &v1Backend{db: db}, nil
+}
+
+func (b *v1Backend) Close() error {
+	return b.db.Close()
+}
+
+func (b *v1Backend) StatsQuery(module string) string {
+	return fmt.Sprintf("SHOW STATS FOR '%s'", module)
+}
+
+// Execute runs q on a separate goroutine since client/v2's Query has no
+// context-aware variant, and returns ctx.Err() as soon as ctx is done
+// instead of waiting for the (still in-flight) HTTP round trip, which
+// newV1Backend also bounds via HTTPConfig.Timeout.
+func (b *v1Backend) Execute(ctx context.Context, runMode, query string) ([]metricRow, error) {
+	database := ""
+	if runMode == "query" {
+		database = "_internal"
+	}
+	q := client.Query{
+		Command:   query,
+		Database:  database,
+		Precision: "s",
+	}
+
+	type result struct {
+		response *client.Response
+		err      error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		response, err := b.db.Query(q)
+		resultCh <- result{response, err}
+	}()
+
+	var response *client.Response
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-resultCh:
+		if res.err != nil {
+			return nil, res.err
+		}
+		response = res.response
+	}
+	if resError := response.Error(); resError != nil {
+		return nil, resError
+	}
+
+	var rows []metricRow
+	for _, r := range response.Results {
+		for _, s := range r.Series {
+			if !seriesMatched(s) {
+				continue
+			}
+			// multiple rows would mean duplicated values for metrics
+			if len(s.Values) > 1 {
+				return nil, fmt.Errorf("query returns multiple rows")
+			}
+			if len(s.Values) != 1 {
+				continue
+			}
+			for i, n := range s.Columns {
+				// skip time column returned in Query mode
+				if runMode == "query" && n == "time" {
+					continue
+				}
+				v, _ := s.Values[0][i].(json.Number).Int64()
+				rows = append(rows, metricRow{Series: s.Name, Tags: s.Tags, Name: n, Value: v})
+			}
+		}
+	}
+	return rows, nil
+}
+
+func seriesMatched(series models.Row) bool {
+	tagsProvided := len(opts.Tags)
+	if opts.RunMode == "query" || len(opts.Module) == 0 {
+		return true
+	}
+
+	if series.Name == opts.Module {
+		if tagsProvided == 0 {
+			return true
+		}
+
+		tagsMatched := 0
+		for k, expected := range opts.Tags {
+			if got, ok := series.Tags[k]; ok && got == expected {
+				tagsMatched++
+			}
+		}
+		if tagsProvided == tagsMatched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// v2Backend talks Flux to an InfluxDB 2.x server (OSS or Cloud) via the
+// official v2 HTTP client, authenticating with an API token instead of
+// username/password.
+type v2Backend struct {
+	client   influxdb2.Client
+	queryAPI api.QueryAPI
+}
+
+func newV2Backend() (*v2Backend, error) {
+	addr := fmt.Sprintf("%s://%s:%d", opts.Schema, opts.Hostname, opts.Port)
+	c := influxdb2.NewClientWithOptions(addr, opts.Token,
+		influxdb2.DefaultOptions().SetTLSConfig(&tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}))
+	return &v2Backend{client: c, queryAPI: c.QueryAPI(opts.Org)}, nil
+}
+
+func (b *v2Backend) Close() error {
+	b.client.Close()
+	return nil
+}
+
+// StatsQuery mirrors the v1 "stats" run mode: it returns the last value of
+// every field for the named measurement in the configured bucket, narrowed
+// to series matching every -t/--tag the same way v1's seriesMatched does.
+// --module and every -t/--tag key/value are Flux string literals, so they go
+// through fluxString rather than being spliced in raw: unlike v1's
+// seriesMatched, which compares tags purely on the Go side, these values
+// become part of the query text itself and a literal double quote in them
+// would otherwise break out of the filter predicate.
+func (b *v2Backend) StatsQuery(module string) string {
+	query := fmt.Sprintf(`from(bucket:%s) |> range(start: -5m) |> filter(fn: (r) => r._measurement == %s)`, fluxString(opts.Bucket), fluxString(module))
+	for k, v := range opts.Tags {
+		query += fmt.Sprintf(` |> filter(fn: (r) => r[%s] == %s)`, fluxString(k), fluxString(v))
+	}
+	return query + " |> last()"
+}
+
+// fluxString renders s as a double-quoted Flux string literal, escaping the
+// backslashes and double quotes Flux itself treats specially.
+func fluxString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+func (b *v2Backend) Execute(ctx context.Context, runMode, query string) ([]metricRow, error) {
+	result, err := b.queryAPI.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var rows []metricRow
+	seen := make(map[string]bool)
+	for result.Next() {
+		record := result.Record()
+		v, ok := flatValue(record.Value())
+		if !ok {
+			continue
+		}
+
+		// a field seen more than once means the -t filter (or the query
+		// itself) didn't narrow the measurement down to a single series, so
+		// it's ambiguous which value the metric should report.
+		name := record.Field()
+		if seen[name] {
+			return nil, fmt.Errorf("query returns multiple rows")
+		}
+		seen[name] = true
+
+		tags := make(map[string]string)
+		for k, v := range record.Values() {
+			if s, ok := v.(string); ok && k != "_field" && k != "_measurement" && k != "_value" {
+				tags[k] = s
+			}
+		}
+
+		rows = append(rows, metricRow{
+			Series: record.Measurement(),
+			Tags:   tags,
+			Name:   name,
+			Value:  v,
+		})
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return rows, nil
+}
+
+// flatValue narrows a Flux record's value to the int64 AddMetric expects.
+func flatValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	default:
+		return 0, false
+	}
+}
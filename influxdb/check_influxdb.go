@@ -1,21 +1,29 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/ajgb/go-plugin"
-	"github.com/influxdata/influxdb/client/v2"
-	"github.com/influxdata/influxdb/models"
-	"os"
+	"github.com/ajgb/monitoring-plugins/graphite"
+	"github.com/ajgb/monitoring-plugins/metricsink"
+	"log"
+	"net/http"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 var opts struct {
 	Hostname           string            `short:"H" long:"hostname" description:"InfluxDB server host" default:"localhost"`
 	Schema             string            `short:"s" long:"schema" description:"Protocol schema" default:"http" required:"true"`
 	Port               int               `short:"P" long:"port" description:"InfluxDB server port" default:"8086" required:"true"`
-	Username           string            `short:"u" long:"username" description:"Username"`
-	Password           string            `short:"p" long:"password" description:"Password"`
+	Username           string            `short:"u" long:"username" description:"Username (API v1)"`
+	Password           string            `short:"p" long:"password" description:"Password (API v1)"`
+	APIVersion         string            `long:"api-version" description:"InfluxDB API version to talk to" default:"1" choice:"1" choice:"2"`
+	Token              string            `long:"token" description:"API token (required for API v2)"`
+	Org                string            `long:"org" description:"Organisation (required for API v2)"`
+	Bucket             string            `long:"bucket" description:"Bucket to query in stats mode (API v2)" default:"monitor"`
 	RunMode            string            `short:"r" long:"run" description:"Run mode: stats or query" default:"stats" required:"true"`
 	Module             string            `short:"M" long:"module" description:"Stats module" default:"runtime" required:"true"`
 	Tags               map[string]string `short:"t" long:"tag" description:"Additional key:value tags identifying stats module"`
@@ -25,29 +33,121 @@ var opts struct {
 	CriticalThreshold  string            `short:"c" long:"critical" description:"Critical threshold"`
 	InsecureSkipVerify bool              `long:"ignore-ssl-errors" description:"Ignore SSL certificate errors"`
 	UOM                string            `long:"uom" description:"UOM for metrics"`
+	Templates          []string          `long:"template" description:"Graphite-style template for rewriting dotted metric names into measurement+tags, e.g. measurement.field* (repeatable, evaluated longest literal prefix first)"`
+	TemplateDefault    string            `long:"template-default" description:"Fallback template applied to metric names matching none of --template"`
+	Separator          string            `long:"separator" description:"Separator used to split metric names for --template matching" default:"."`
+	Output             []string          `long:"output" description:"Metric output backend (repeatable): nagios, graphite, influx, statsd" default:"nagios"`
+	GraphiteAddr       string            `long:"graphite-addr" description:"host:port of Graphite plaintext carbon receiver"`
+	SinkInfluxURL      string            `long:"sink-influx-url" description:"InfluxDB 2.x base URL to forward metrics to (--output influx)"`
+	SinkInfluxToken    string            `long:"sink-influx-token" description:"InfluxDB 2.x API token (--output influx)"`
+	SinkInfluxOrg      string            `long:"sink-influx-org" description:"InfluxDB 2.x organisation (--output influx)"`
+	SinkInfluxBucket   string            `long:"sink-influx-bucket" description:"InfluxDB 2.x bucket (--output influx)"`
+	StatsdAddr         string            `long:"statsd-addr" description:"host:port of StatsD daemon"`
+	FlushTimeout       int               `long:"flush-timeout" description:"Max seconds to wait for --output sinks to flush" default:"5"`
+	Timeout            int               `long:"timeout" description:"Connection timeout in seconds" default:"30"`
+	Daemon             bool              `long:"daemon" description:"Run as a long-lived exporter instead of a single check"`
+	Listen             string            `long:"listen" description:"Address to serve /metrics and /check on in --daemon mode" default:":9122"`
+	Interval           int               `long:"interval" description:"Seconds between polls in --daemon mode" default:"60"`
 }
 
-func main() {
-	var (
-		modeQuery string
-		database  string
-		results   []client.Result
-		gotData   bool
-	)
-	wantedMetrics := make(map[string]bool)
+// templates holds the parsed --template patterns, or nil if none were given,
+// in which case metrics keep their raw InfluxDB column/field name.
+var templates *graphite.Templates
 
+// sinks forwards every metric to the backends selected by --output, in
+// addition to the standard Nagios perfdata exit.
+var sinks *metricsink.Set
+
+type promSample struct {
+	name  string
+	value float64
+}
+
+func main() {
 	// init plugin
 	check := checkPlugin()
 
 	if err := check.ParseArgs(&opts); err != nil {
 		check.ExitCritical("Error parsing arguments: %s\n", err)
 	}
+
+	if opts.APIVersion == "2" && (opts.Token == "" || opts.Org == "") {
+		check.ExitCritical("--token and --org are required when --api-version is 2\n")
+	}
+
+	if len(opts.Templates) > 0 {
+		tpls, err := graphite.NewTemplates(opts.Templates, opts.TemplateDefault, opts.Separator)
+		if err != nil {
+			check.ExitCritical("Invalid --template: %s", err)
+		}
+		templates = tpls
+	}
+
+	backends, err := metricsink.BuildSinks(opts.Output, opts.GraphiteAddr, opts.SinkInfluxURL, opts.SinkInfluxToken, opts.SinkInfluxOrg, opts.SinkInfluxBucket, opts.StatsdAddr)
+	if err != nil {
+		check.ExitCritical("Invalid --output: %s", err)
+	}
+	sinks = metricsink.NewSet(backends...)
+
+	if opts.Daemon {
+		runDaemon()
+		return
+	}
+
 	defer check.Final()
+	defer func() {
+		for _, err := range sinks.Flush(time.Duration(opts.FlushTimeout) * time.Second) {
+			check.AddMessage("metricsink: %s", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Timeout)*time.Second)
+	defer cancel()
+	if err := RunOnce(ctx, check, nil); err != nil {
+		check.ExitCritical("%s", err)
+	}
+}
+
+// RunOnce performs a single collection pass: it connects to InfluxDB, runs
+// the configured stats/query mode and adds metrics to check exactly as the
+// single-shot plugin always has. It returns an error for a failed
+// connection, query or empty result set instead of exiting, so --daemon
+// mode can skip a bad tick; check may by then already hold the run mode's
+// message and any metrics added before the failure. An invalid run mode
+// or query is a configuration error and still goes through check.ExitCritical
+// as before, since it would recur identically on every tick. If collecting is
+// non-nil, every sample produced by this pass is also appended to it, for
+// --daemon mode to serve on /metrics; callers that don't need that (a plain
+// check, or a /check request that only cares about the error) pass nil.
+func RunOnce(ctx context.Context, check *plugin.Plugin, collecting *[]promSample) error {
+	var (
+		modeQuery string
+		results   []metricRow
+		gotData   bool
+	)
+	wantedMetrics := make(map[string]bool)
+
+	var (
+		backend queryBackend
+		err     error
+	)
+	switch opts.APIVersion {
+	case "1":
+		backend, err = newV1Backend()
+	case "2":
+		backend, err = newV2Backend()
+	default:
+		check.ExitCritical("Unknown API version: %s\n", opts.APIVersion)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create InfluxDB client: %s", err)
+	}
+	defer backend.Close()
 
 	// mode specific settings
 	switch opts.RunMode {
 	case "stats":
-		modeQuery = fmt.Sprintf("SHOW STATS FOR '%s'", opts.Module)
+		modeQuery = backend.StatsQuery(opts.Module)
 
 		for _, m := range opts.Metrics {
 			wantedMetrics[m] = true
@@ -71,102 +171,151 @@ func main() {
 			check.ExitCritical("Query parameter required in query mode\n")
 		}
 		check.AddMessage("Query '%s'", opts.Query)
-		database = "_internal"
 	default:
 		check.ExitCritical("Unknown mode: %s\n", opts.RunMode)
 	}
 
-	// Influxdb Client
-	clientConfig := client.HTTPConfig{
-		Addr:               fmt.Sprintf("%s://%s:%d", opts.Schema, opts.Hostname, opts.Port),
-		InsecureSkipVerify: opts.InsecureSkipVerify,
-	}
-
-	if len(opts.Username) > 0 {
-		clientConfig.Username = opts.Username
-		clientConfig.Password = opts.Password
-	}
-	db, err := client.NewHTTPClient(clientConfig)
-	if err != nil {
-		check.ExitCritical("Failed to create InfluxDB client: %s", err)
-	}
-	defer db.Close()
-
 	// execute query
-	q := client.Query{
-		Command:   modeQuery,
-		Database:  database,
-		Precision: "s",
-	}
-	if response, err := db.Query(q); err == nil {
-		if resError := response.Error(); resError != nil {
-			check.ExitCritical("Request error: %s", resError)
-		}
-		results = response.Results
-	} else {
-		check.ExitCritical("Failed to query InfluxDB server: %s", err)
+	results, err = backend.Execute(ctx, opts.RunMode, modeQuery)
+	if err != nil {
+		return fmt.Errorf("failed to query InfluxDB server: %s", err)
 	}
 
 	// process response
-	for _, r := range results {
-		for _, s := range r.Series {
-			if seriesMatched(s) {
-				// multiple rows would mean duplicated values for metrics
-				if len(s.Values) > 1 {
-					check.ExitCritical("Query returns multiple rows")
-				}
-				if len(s.Values) != 1 {
-					continue
-				}
-				for i, n := range s.Columns {
-					// skip time column returned in Query mode
-					if opts.RunMode == "query" && n == "time" {
-						continue
-					}
-					// accept all columns returned in Query mode
-					// or if metric  was requested
-					// or no filter was specified
-					if _, ok := wantedMetrics[n]; opts.RunMode == "query" || ok || len(wantedMetrics) == 0 {
-						v, _ := s.Values[0][i].(json.Number).Int64()
-						err := check.AddMetric(n, v, opts.UOM, opts.WarningThreshold, opts.CriticalThreshold)
-						if err != nil {
-							check.ExitCritical("%s", err)
-						}
-						gotData = true
-					}
-				}
+	for _, row := range results {
+		// accept all columns returned in Query mode
+		// or if metric was requested
+		// or no filter was specified
+		if _, ok := wantedMetrics[row.Name]; opts.RunMode == "query" || ok || len(wantedMetrics) == 0 {
+			label := metricLabel(row.Name)
+			if err := check.AddMetric(label, row.Value, opts.UOM, opts.WarningThreshold, opts.CriticalThreshold); err != nil {
+				return fmt.Errorf("%s", err)
+			}
+			sinks.Add(label, float64(row.Value), row.Tags, time.Now())
+			if collecting != nil {
+				*collecting = append(*collecting, promSample{label, float64(row.Value)})
 			}
+			gotData = true
 		}
 	}
 
 	if !gotData {
-		check.ExitCritical("No data returned for %s", os.Args[1:])
+		return fmt.Errorf("no data returned for %s mode %s", opts.Module, opts.RunMode)
 	}
+	return nil
 }
 
-func seriesMatched(series models.Row) bool {
-	tagsProvided := len(opts.Tags)
-	if opts.RunMode == "query" || len(opts.Module) == 0 {
-		return true
+// metricLabel rewrites name through --template, if configured, otherwise
+// returns it unchanged.
+func metricLabel(name string) string {
+	if templates != nil {
+		return templates.Apply(name)
 	}
+	return name
+}
 
-	if series.Name == opts.Module {
-		if tagsProvided == 0 {
-			return true
-		}
+// daemonState is the most recent poll's outcome, served by /metrics and
+// refreshed on every tick of --interval.
+type daemonState struct {
+	samples []promSample
+	err     error
+}
 
-		tagsMatched := 0
-		for k, expected := range opts.Tags {
-			if got, ok := series.Tags[k]; ok && got == expected {
-				tagsMatched++
-			}
+var (
+	stateMu sync.RWMutex
+	state   daemonState
+)
+
+// runDaemon polls InfluxDB every --interval seconds, caching the result
+// behind stateMu for /metrics. /check runs its own poll on demand instead of
+// reading the cache, so a synchronous Nagios-style invocation always
+// reflects the current state of the server.
+func runDaemon() {
+	poll()
+
+	ticker := time.NewTicker(time.Duration(opts.Interval) * time.Second)
+	defer ticker.Stop()
+	go func() {
+		for range ticker.C {
+			poll()
 		}
-		if tagsProvided == tagsMatched {
-			return true
+	}()
+
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/check", checkHandler)
+	log.Fatal(http.ListenAndServe(opts.Listen, nil))
+}
+
+// poll runs one collection pass and stores it as the cached daemonState read
+// by /metrics.
+func poll() {
+	check := checkPlugin()
+	samples := []promSample{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Timeout)*time.Second)
+	err := RunOnce(ctx, check, &samples)
+	cancel()
+
+	stateMu.Lock()
+	state = daemonState{samples: samples, err: err}
+	stateMu.Unlock()
+
+	for _, ferr := range sinks.Flush(time.Duration(opts.FlushTimeout) * time.Second) {
+		log.Printf("metricsink: %s", ferr)
+	}
+	if err != nil {
+		log.Printf("poll failed: %s", err)
+	}
+}
+
+// metricsHandler renders the most recently cached poll as Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stateMu.RLock()
+	samples := state.samples
+	stateMu.RUnlock()
+
+	seen := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		name := promMetricName(s.name)
+		if !seen[name] {
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			seen[name] = true
 		}
+		fmt.Fprintf(w, "%s %v\n", name, s.value)
+	}
+}
+
+// checkHandler runs a synchronous poll and reports whether it succeeded: an
+// "OK" body with HTTP 200, or a "CRITICAL: <error>" body with HTTP 503, for
+// tools expecting a single Nagios-style request/response. Warning and
+// critical thresholds are not evaluated here, so a metric beyond them still
+// gets "OK".
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	check := checkPlugin()
+	err := RunOnce(r.Context(), check, nil)
+	for _, ferr := range sinks.Flush(time.Duration(opts.FlushTimeout) * time.Second) {
+		log.Printf("metricsink: %s", ferr)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "CRITICAL: %s\n", err)
+		return
 	}
+	fmt.Fprintln(w, "OK")
+}
+
+var promNameRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
 
-	return false
+// promMetricName rewrites a perfdata label, which may contain Graphite-style
+// tags or characters Prometheus doesn't allow, into a valid Prometheus
+// metric name.
+func promMetricName(name string) string {
+	name = promNameRe.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
 }
 
 func checkPlugin() *plugin.Plugin {
@@ -178,6 +327,11 @@ This plugin tests InfluxDB TimeSeries database server.
 
 	check.Description = `DESCRIPTION
 
+Plugin supports both InfluxDB 1.x (InfluxQL) and 2.x (Flux) servers,
+selected with [--api-version]. API v1 authenticates with [-u|--username]
+and [-p|--password]; API v2 requires [--token] and [--org], and uses
+[--bucket] (default "monitor") as the source for stats mode.
+
 Plugin supports following run modes:
 - stats:    runs SHOW STATS FOR 'MODULE'.
             Where MODULE is provided by [-M|--module] parameter.
@@ -192,6 +346,29 @@ Plugin supports following run modes:
 
 Note: Warning and critical thresholds are applied to all metrics.
 
+[--template] rewrites a dotted metric name into a Graphite-style measurement
+plus tags, the same way check_api_json does, giving a perfdata label of
+"measurement,tag1=v1,tag2=v2.field" instead of the raw name. Multiple
+[--template] patterns are evaluated longest literal prefix first;
+[--template-default] is used for names matching none of them.
+
+[--output] forwards every metric to one or more backends in addition to the
+standard Nagios perfdata exit: "graphite" (plaintext carbon protocol,
+[--graphite-addr]), "influx" (InfluxDB 2.x line protocol,
+[--sink-influx-url] [--sink-influx-token] [--sink-influx-org]
+[--sink-influx-bucket]) and "statsd" (gauges, [--statsd-addr]). Repeat
+[--output] to feed several at once. Sinks are flushed in parallel and
+abandoned after [--flush-timeout] seconds so a slow backend cannot delay the
+check's own exit.
+
+[--daemon] runs the plugin as a long-lived exporter instead of exiting after
+one check: it polls InfluxDB every [--interval] seconds and listens on
+[--listen], serving the latest poll as Prometheus gauges on /metrics while
+still answering /check synchronously with an "OK"/"CRITICAL" body and a
+matching HTTP status, for tools that expect a single Nagios-style
+request/response. /check reports CRITICAL only when the poll itself fails;
+warning and critical thresholds are not applied to it.
+
 Examples:
 - List only specified metrics from runtime
 $ check_influxdb -H localhost -m Alloc -m TotalAlloc --uom c
@@ -212,6 +389,13 @@ OK: shard stats (database:measurements, id:20) for: diskBytes | diskBytes=972026
 - Connect with username and password using SSL
 $ check_influxdb -H localhost -s https -u admin -p s3cr3t -M queryExecutor -m queriesActive
 OK: queryExecutor stats for: queriesActive | queriesActive=23;;;;
+
+- Query an InfluxDB 2.x Cloud bucket
+$ check_influxdb -H us-west-2-1.aws.cloud2.influxdata.com -s https --api-version 2 --token $TOKEN --org myorg --bucket monitor -M runtime -m Alloc
+OK: runtime stats for: Alloc | Alloc=24334856;;;;
+
+- Run as a Prometheus exporter, polling every 30s
+$ check_influxdb -H localhost --daemon --listen :9122 --interval 30
 `
 	return check
 }
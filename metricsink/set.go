@@ -0,0 +1,111 @@
+// Package metricsink lets a check forward every metric it collects to one
+// or more external TSDB/monitoring backends in addition to the standard
+// Nagios perfdata exit, without letting a slow backend delay that exit.
+package metricsink
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Sample is one metric observation queued for delivery to a Sink.
+type Sample struct {
+	Name  string
+	Value float64
+	Tags  map[string]string
+	Time  time.Time
+}
+
+// Sink forwards a batch of samples to an external backend, opening whatever
+// connection it needs once per Emit call rather than once per sample.
+// deadline is how long the whole batch has left to be delivered; Set.Flush
+// layers its own context cancellation on top as a backstop.
+type Sink interface {
+	Emit(samples []Sample, deadline time.Duration) error
+}
+
+// Set fans metrics out to every registered Sink, batching them up until
+// Flush is called.
+type Set struct {
+	sinks []Sink
+
+	mu      sync.Mutex
+	pending []Sample
+}
+
+// NewSet returns a Set forwarding to the given sinks. A nil/empty sinks list
+// is valid; Add and Flush become no-ops.
+func NewSet(sinks ...Sink) *Set {
+	return &Set{sinks: sinks}
+}
+
+// Add queues a metric for delivery to every sink. Safe for concurrent use.
+func (s *Set) Add(name string, value float64, tags map[string]string, ts time.Time) {
+	if s == nil || len(s.sinks) == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.pending = append(s.pending, Sample{name, value, tags, ts})
+	s.mu.Unlock()
+}
+
+// Flush delivers every queued metric to every sink in parallel, a single
+// batched Emit call per sink, abandoning any sink still running once
+// deadline elapses so a slow backend can't delay the plugin's own Nagios
+// timeout. It returns one error per sink that failed before deadline, plus a
+// single context deadline error if any sink was still running at deadline.
+func (s *Set) Flush(deadline time.Duration) []error {
+	if s == nil || len(s.sinks) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	addErr := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+
+	for _, sink := range s.sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			if err := sink.Emit(batch, deadline); err != nil {
+				addErr(err)
+			}
+		}(sink)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		addErr(ctx.Err())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return errs
+}
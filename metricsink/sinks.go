@@ -0,0 +1,162 @@
+package metricsink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GraphiteSink writes metrics using the Graphite plaintext protocol
+// ("name value timestamp\n") over TCP, one connection per Emit call shared
+// by every sample in the batch.
+type GraphiteSink struct {
+	Addr string
+}
+
+func (g *GraphiteSink) Emit(samples []Sample, deadline time.Duration) error {
+	conn, err := net.DialTimeout("tcp", g.Addr, deadline)
+	if err != nil {
+		return fmt.Errorf("graphite: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(deadline)); err != nil {
+		return fmt.Errorf("graphite: %s", err)
+	}
+
+	for _, s := range samples {
+		if _, err := fmt.Fprintf(conn, "%s %v %d\n", s.Name, s.Value, s.Time.Unix()); err != nil {
+			return fmt.Errorf("graphite: %s", err)
+		}
+	}
+	return nil
+}
+
+// StatsdSink writes metrics as StatsD gauges ("name:value|g") over UDP, one
+// connection per Emit call shared by every sample in the batch.
+type StatsdSink struct {
+	Addr string
+}
+
+func (s *StatsdSink) Emit(samples []Sample, deadline time.Duration) error {
+	conn, err := net.DialTimeout("udp", s.Addr, deadline)
+	if err != nil {
+		return fmt.Errorf("statsd: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(deadline)); err != nil {
+		return fmt.Errorf("statsd: %s", err)
+	}
+
+	for _, m := range samples {
+		if _, err := fmt.Fprintf(conn, "%s:%v|g", m.Name, m.Value); err != nil {
+			return fmt.Errorf("statsd: %s", err)
+		}
+	}
+	return nil
+}
+
+// InfluxSink writes metrics as InfluxDB 2.x line protocol via the /api/v2/write
+// HTTP endpoint, token-authenticated, one request per Emit call carrying every
+// sample in the batch.
+type InfluxSink struct {
+	URL    string
+	Token  string
+	Org    string
+	Bucket string
+
+	client *http.Client
+}
+
+func NewInfluxSink(rawURL, token, org, bucket string) *InfluxSink {
+	return &InfluxSink{
+		URL:    rawURL,
+		Token:  token,
+		Org:    org,
+		Bucket: bucket,
+		client: &http.Client{},
+	}
+}
+
+func (i *InfluxSink) Emit(samples []Sample, deadline time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	var body strings.Builder
+	for _, s := range samples {
+		body.WriteString(lineProtocol(s.Name, s.Tags, s.Value, s.Time))
+	}
+
+	writeURL := fmt.Sprintf("%s/api/v2/write?org=%s&bucket=%s&precision=ns",
+		strings.TrimRight(i.URL, "/"), url.QueryEscape(i.Org), url.QueryEscape(i.Bucket))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", writeURL, strings.NewReader(body.String()))
+	if err != nil {
+		return fmt.Errorf("influx: %s", err)
+	}
+	req.Header.Set("Authorization", "Token "+i.Token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("influx: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("influx: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// BuildSinks constructs one Sink per requested backend name. "nagios" is
+// accepted but produces no Sink since it is handled by the caller's own
+// AddMetric/perfdata path, not by this package.
+func BuildSinks(outputs []string, graphiteAddr, influxURL, influxToken, influxOrg, influxBucket, statsdAddr string) ([]Sink, error) {
+	var sinks []Sink
+	for _, o := range outputs {
+		switch o {
+		case "nagios":
+			// handled by the caller's own Nagios perfdata path
+		case "graphite":
+			if graphiteAddr == "" {
+				return nil, fmt.Errorf("--graphite-addr is required for --output graphite")
+			}
+			sinks = append(sinks, &GraphiteSink{Addr: graphiteAddr})
+		case "influx":
+			if influxURL == "" || influxToken == "" || influxBucket == "" {
+				return nil, fmt.Errorf("an InfluxDB URL, token and bucket are required for --output influx")
+			}
+			sinks = append(sinks, NewInfluxSink(influxURL, influxToken, influxOrg, influxBucket))
+		case "statsd":
+			if statsdAddr == "" {
+				return nil, fmt.Errorf("--statsd-addr is required for --output statsd")
+			}
+			sinks = append(sinks, &StatsdSink{Addr: statsdAddr})
+		default:
+			return nil, fmt.Errorf("unknown --output backend: %s", o)
+		}
+	}
+	return sinks, nil
+}
+
+// lineProtocol renders name/tags/value/ts as a single InfluxDB line protocol
+// point. A dotted name is split into measurement + field, matching the
+// graphite package's "measurement.field" convention; undotted names are
+// written as a single "value" field.
+func lineProtocol(name string, tags map[string]string, value float64, ts time.Time) string {
+	measurement, field := name, "value"
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		measurement, field = name[:i], name[i+1:]
+	}
+
+	var b strings.Builder
+	b.WriteString(measurement)
+	for k, v := range tags {
+		fmt.Fprintf(&b, ",%s=%s", k, v)
+	}
+	fmt.Fprintf(&b, " %s=%v %d\n", field, value, ts.UnixNano())
+	return b.String()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/ajgb/go-config"
+	"github.com/ajgb/go-plugin"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var opts struct {
+	Broker            string   `short:"H" long:"broker" description:"MQTT broker URI, e.g. tcp://localhost:1883" required:"true"`
+	Topics            []string `short:"T" long:"topic" description:"Topic to subscribe to (repeatable)" required:"true"`
+	QOS               int      `long:"qos" description:"MQTT QoS level" default:"0"`
+	ClientID          string   `long:"client-id" description:"MQTT client id (default: check_mqtt_json-<pid>, to avoid concurrent invocations evicting each other's broker session)"`
+	Username          string   `short:"u" long:"username" description:"Username"`
+	Password          string   `short:"p" long:"password" description:"Password"`
+	TLSCA             string   `long:"tls-ca" description:"Path to CA certificate to verify broker"`
+	Wait              int      `long:"wait" description:"Max seconds to wait for a message" default:"10"`
+	Message           string   `short:"M" long:"message" description:"Initial plugin message"`
+	Keys              []string `short:"m" long:"metric" description:"List of path based keys to query" required:"true"`
+	BasenameMetric    bool     `short:"b" long:"basename" description:"Ignore leading path of metrics"`
+	WarningThreshold  string   `short:"w" long:"warning" description:"Warning threshold"`
+	CriticalThreshold string   `short:"c" long:"critical" description:"Critical threshold"`
+	UOM               string   `long:"uom" description:"UOM for keys"`
+}
+
+func main() {
+	// init plugin
+	check := checkPlugin()
+
+	if err := check.ParseArgs(&opts); err != nil {
+		check.ExitCritical("Error parsing arguments: %s\n", err)
+	}
+	defer check.Final()
+
+	if opts.ClientID == "" {
+		// Per-process default: the MQTT spec has a broker drop the previous
+		// session when a new CONNECT arrives with the same client id, so a
+		// shared static default would make concurrent invocations of this
+		// check against the same broker disconnect each other.
+		opts.ClientID = fmt.Sprintf("check_mqtt_json-%d", os.Getpid())
+	}
+
+	switch len(opts.Message) {
+	case 0:
+		check.AddMessage(strings.Join(opts.Topics, ", "))
+	default:
+		check.AddMessage(opts.Message)
+	}
+
+	payload, topic, err := waitForMessage()
+	if err != nil {
+		check.ExitCritical("%s", err)
+	}
+
+	data, err := config.ProcessJson(strings.NewReader(payload))
+	if err != nil {
+		check.ExitCritical("Failed to decode JSON payload from %s: %s", topic, err)
+	}
+	for _, key := range opts.Keys {
+		addKey(check, data, key)
+	}
+}
+
+// waitForMessage connects to the broker, subscribes to every configured
+// topic and listens for up to [--wait] seconds. A retained message arrives
+// the instant the subscription completes and is returned immediately, since
+// it's already the topic's current value and there's nothing to wait for;
+// otherwise every live message is drained for the full window and the most
+// recent one is returned, so a live topic reports its most recent value
+// rather than whichever arrived first. It errors if nothing arrived at all
+// (e.g. no retained message and no live publish).
+func waitForMessage() (string, string, error) {
+	msgs := make(chan MQTT.Message, 1)
+
+	clientOpts := MQTT.NewClientOptions()
+	clientOpts.AddBroker(opts.Broker)
+	clientOpts.SetClientID(opts.ClientID)
+	if opts.Username != "" {
+		clientOpts.SetUsername(opts.Username)
+		clientOpts.SetPassword(opts.Password)
+	}
+	if opts.TLSCA != "" {
+		tlsConfig, err := tlsConfigWithCA(opts.TLSCA)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to load TLS CA: %s", err)
+		}
+		clientOpts.SetTLSConfig(tlsConfig)
+	}
+	clientOpts.SetDefaultPublishHandler(func(client MQTT.Client, msg MQTT.Message) {
+		// keep the newest message: if the buffer is full, discard the
+		// older buffered one instead of the one just received
+		for {
+			select {
+			case msgs <- msg:
+				return
+			default:
+				select {
+				case <-msgs:
+				default:
+				}
+			}
+		}
+	})
+
+	client := MQTT.NewClient(clientOpts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return "", "", fmt.Errorf("failed to connect to %s: %s", opts.Broker, token.Error())
+	}
+	defer client.Disconnect(250)
+
+	for _, topic := range opts.Topics {
+		if token := client.Subscribe(topic, byte(opts.QOS), nil); token.Wait() && token.Error() != nil {
+			return "", "", fmt.Errorf("failed to subscribe to %s: %s", topic, token.Error())
+		}
+	}
+
+	deadline := time.After(time.Duration(opts.Wait) * time.Second)
+	var last MQTT.Message
+	for {
+		select {
+		case msg := <-msgs:
+			if msg.Retained() {
+				return string(msg.Payload()), msg.Topic(), nil
+			}
+			last = msg
+		case <-deadline:
+			if last == nil {
+				return "", "", fmt.Errorf("timed out after %ds waiting for a message on %s", opts.Wait, strings.Join(opts.Topics, ", "))
+			}
+			return string(last.Payload()), last.Topic(), nil
+		}
+	}
+}
+
+func tlsConfigWithCA(caFile string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("unable to parse CA certificate %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+func addKey(check *plugin.Plugin, data *config.Config, key string) {
+	value, err := config.Get(data.Root, key)
+	if err != nil {
+		check.ExitUnknown("Unable to locate key %s: %s", key, err)
+	}
+
+	switch value.(type) {
+	case json.Number:
+		value, err := data.Number(key)
+		if err != nil {
+			check.ExitUnknown("Unable to process key %s as number: %s", key, err)
+		}
+		check.AddMetric(basename(key), value, opts.UOM, opts.WarningThreshold, opts.CriticalThreshold)
+	case map[string]interface{}:
+		subtree, err := data.Map(key)
+		if err != nil {
+			check.ExitUnknown("Unable to process key %s as map: %s", key, err)
+		}
+		for child_key, _ := range subtree {
+			addKey(check, data, fmt.Sprintf("%s.%s", key, child_key))
+		}
+	case []interface{}, []string, []json.Number, []int, []float64:
+		// skip slices
+	default:
+		value, err := data.String(key)
+		if err != nil {
+			check.ExitUnknown("Unable to process key %s as string: %s", key, err)
+		}
+		check.AddMessage("%s is %s", basename(key), value)
+	}
+}
+
+func basename(key string) string {
+	if opts.BasenameMetric {
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			return key[i+1:]
+		}
+	}
+	return key
+}
+
+func checkPlugin() *plugin.Plugin {
+	check := plugin.New("check_mqtt_json", "v1.0.0")
+	check.Preamble = `Copyright (c) 2017 Alex J. G. Burzyński (ajgb@ajgb.org)
+
+This plugin tests JSON payloads published to MQTT topics.
+`
+
+	check.Description = `DESCRIPTION
+
+Subscribes to one or more MQTT topics and evaluates the most recent JSON
+payload received (retained or live) against warning/critical thresholds,
+using the same path-based key format as check_json_api:
+
+- toplevelmetric - { "toplevelmetric": ... }
+- parent.child   - { "parent": { "child": ... } ... }
+- list.1.item    - { "list": [ { ... }, { "item": ... } ... ] }
+
+If key path points to object all its children are returned.
+
+List values are ignored.
+
+Numeric items are added to perfomance data, anything else is added to check message.
+
+Note: Warning and critical thresholds are applied to all metrics.
+
+Examples:
+- Check a Telegraf MQTT consumer feed
+$ check_mqtt_json -H tcp://localhost:1883 -T sensors/+/temperature -m value -w 30 -c 40
+OK: sensors/+/temperature | value=21.5;30;40;;
+
+- Check a Home Assistant status topic with authentication
+$ check_mqtt_json -H ssl://broker.example.com:8883 -T homeassistant/status -u monitor -p s3cr3t --tls-ca /etc/ssl/ca.pem -m state
+OK: homeassistant/status, state is online
+`
+	return check
+}